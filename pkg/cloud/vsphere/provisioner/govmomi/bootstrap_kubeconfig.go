@@ -0,0 +1,248 @@
+package govmomi
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+const (
+	// BootstrapKubeConfigValid marks a candidate kubeconfig that last probed healthy.
+	BootstrapKubeConfigValid BootstrapKubeConfigStatus = "Valid"
+	// BootstrapKubeConfigInvalid marks a candidate kubeconfig that has been demoted
+	// after repeated probe failures.
+	BootstrapKubeConfigInvalid BootstrapKubeConfigStatus = "Invalid"
+
+	// bootstrapKubeConfigMaxConsecutiveFailures is the number of consecutive failed
+	// /readyz probes a candidate tolerates before being marked invalid.
+	bootstrapKubeConfigMaxConsecutiveFailures = 3
+
+	// bootstrapKubeConfigActiveAnnotation caches the name of the candidate that last
+	// probed healthy, so future lookups try it first instead of re-probing every
+	// candidate in order.
+	bootstrapKubeConfigActiveAnnotation = "vsphere.cluster.k8s.io/active-kubeconfig"
+
+	// bootstrapKubeConfigProbeTimeout bounds how long a single /readyz probe may take
+	// before the candidate is considered unreachable.
+	bootstrapKubeConfigProbeTimeout = 5 * time.Second
+)
+
+// BootstrapKubeConfigStatus reflects whether a candidate kubeconfig last responded
+// to a health probe.
+type BootstrapKubeConfigStatus string
+
+// BootstrapKubeConfig is one of potentially several candidate kubeconfigs stored in
+// the secret named by constants.KubeConfigSecretName. Multiple candidates allow
+// GetKubeConfig to fail over to a still-reachable API server, e.g. after a VIP
+// move or an HA control plane rebuild.
+type BootstrapKubeConfig struct {
+	name              string
+	data              string
+	status            BootstrapKubeConfigStatus
+	consecutiveFailed int
+}
+
+// NewBootstrapKubeConfig creates a candidate in the Valid state.
+func NewBootstrapKubeConfig(name, data string) *BootstrapKubeConfig {
+	return &BootstrapKubeConfig{
+		name:   name,
+		data:   data,
+		status: BootstrapKubeConfigValid,
+	}
+}
+
+// Name is the secret data key this candidate was read from, e.g. "kubeconfig.0".
+func (b *BootstrapKubeConfig) Name() string {
+	return b.name
+}
+
+// Data is the raw kubeconfig blob for this candidate.
+func (b *BootstrapKubeConfig) Data() string {
+	return b.data
+}
+
+// Status reports whether this candidate is still considered usable.
+func (b *BootstrapKubeConfig) Status() BootstrapKubeConfigStatus {
+	return b.status
+}
+
+// MarkFail records a failed probe against this candidate, demoting it to
+// BootstrapKubeConfigInvalid once bootstrapKubeConfigMaxConsecutiveFailures
+// consecutive failures have been observed.
+func (b *BootstrapKubeConfig) MarkFail() {
+	b.consecutiveFailed++
+	if b.consecutiveFailed >= bootstrapKubeConfigMaxConsecutiveFailures {
+		b.status = BootstrapKubeConfigInvalid
+	}
+}
+
+// markHealthy resets the failure count after a successful probe.
+func (b *BootstrapKubeConfig) markHealthy() {
+	b.consecutiveFailed = 0
+	b.status = BootstrapKubeConfigValid
+}
+
+// bootstrapKubeConfigManager selects the first candidate kubeconfig whose /readyz
+// endpoint answers within probeTimeout, preferring the candidate cached on the
+// Cluster object from the previous selection.
+type bootstrapKubeConfigManager struct {
+	candidates   []*BootstrapKubeConfig
+	probeTimeout time.Duration
+	// probe is overridable in tests to avoid making real network calls.
+	probe func(candidate *BootstrapKubeConfig, timeout time.Duration) bool
+}
+
+func newBootstrapKubeConfigManager(candidates []*BootstrapKubeConfig) *bootstrapKubeConfigManager {
+	return &bootstrapKubeConfigManager{
+		candidates:   candidates,
+		probeTimeout: bootstrapKubeConfigProbeTimeout,
+		probe:        probeReadyz,
+	}
+}
+
+// selectActive returns the first healthy candidate, trying preferredName first
+// when it is still present among the candidates. When no candidate answers the
+// probe, it returns the first candidate that was not already demoted, and it
+// returns an error only when every candidate is demoted.
+func (m *bootstrapKubeConfigManager) selectActive(preferredName string) (*BootstrapKubeConfig, error) {
+	ordered := m.candidates
+	if preferredName != "" {
+		ordered = make([]*BootstrapKubeConfig, 0, len(m.candidates))
+		for _, c := range m.candidates {
+			if c.Name() == preferredName {
+				ordered = append(ordered, c)
+			}
+		}
+		for _, c := range m.candidates {
+			if c.Name() != preferredName {
+				ordered = append(ordered, c)
+			}
+		}
+	}
+
+	var fallback *BootstrapKubeConfig
+	for _, candidate := range ordered {
+		if candidate.Status() == BootstrapKubeConfigInvalid {
+			continue
+		}
+		if fallback == nil {
+			fallback = candidate
+		}
+		if m.probe(candidate, m.probeTimeout) {
+			candidate.markHealthy()
+			return candidate, nil
+		}
+		candidate.MarkFail()
+		klog.Warningf("Candidate kubeconfig %q failed /readyz probe", candidate.Name())
+	}
+
+	if fallback == nil {
+		return nil, fmt.Errorf("all candidate kubeconfigs demoted")
+	}
+
+	// None of the remaining candidates answered /readyz, but at least one
+	// hasn't yet been demoted. Reads against a single legacy kubeconfig
+	// secret used to succeed unconditionally, so rather than hard-failing
+	// callers that have their own retry logic, fall back to it and let them
+	// discover the outage themselves.
+	klog.Warningf("No candidate kubeconfig answered /readyz, falling back to %q", fallback.Name())
+	return fallback, nil
+}
+
+// probeReadyz hits the candidate's /readyz endpoint and reports whether it
+// answered successfully within timeout. It is built on kubernetes.Clientset's
+// REST client rather than rest.HTTPClientFor, which this repo's vendored
+// client-go predates.
+func probeReadyz(candidate *BootstrapKubeConfig, timeout time.Duration) bool {
+	rc, err := clientcmd.RESTConfigFromKubeConfig([]byte(candidate.Data()))
+	if err != nil {
+		return false
+	}
+	rc.Timeout = timeout
+
+	clusterclient, err := kubernetes.NewForConfig(rc)
+	if err != nil {
+		return false
+	}
+
+	return clusterclient.CoreV1().RESTClient().Get().AbsPath("/readyz").Do().Error() == nil
+}
+
+// getBootstrapKubeConfigCandidates reads the ordered candidate kubeconfigs
+// (kubeconfig.0, kubeconfig.1, ...) out of the secret named by
+// constants.KubeConfigSecretName. A secret containing the legacy single-blob
+// key constants.KubeConfigSecretData is treated as a single candidate, so
+// existing clusters keep working unchanged.
+func (pv *Provisioner) getBootstrapKubeConfigCandidates(cluster *clusterv1.Cluster) ([]*BootstrapKubeConfig, error) {
+	if remoteKubeConfig, imported, err := pv.ImportRemoteSecret(cluster); err != nil {
+		return nil, err
+	} else if imported {
+		return []*BootstrapKubeConfig{NewBootstrapKubeConfig("remote-secret", remoteKubeConfig)}, nil
+	}
+
+	secret, err := pv.k8sClient.Core().Secrets(cluster.Namespace).Get(fmt.Sprintf(constants.KubeConfigSecretName, cluster.UID), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*BootstrapKubeConfig
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("%s.%d", constants.KubeConfigSecretData, i)
+		data, ok := secret.Data[key]
+		if !ok {
+			break
+		}
+		candidates = append(candidates, NewBootstrapKubeConfig(key, string(data)))
+	}
+
+	if len(candidates) == 0 {
+		if data, ok := secret.Data[constants.KubeConfigSecretData]; ok {
+			candidates = append(candidates, NewBootstrapKubeConfig(constants.KubeConfigSecretData, string(data)))
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("secret %s has no kubeconfig candidates", secret.Name)
+	}
+	return candidates, nil
+}
+
+// selectBootstrapKubeConfig picks the best candidate kubeconfig for cluster and
+// caches its name on the Cluster object's annotations so subsequent calls try it
+// first instead of re-probing every candidate.
+func (pv *Provisioner) selectBootstrapKubeConfig(cluster *clusterv1.Cluster) (*BootstrapKubeConfig, error) {
+	candidates, err := pv.getBootstrapKubeConfigCandidates(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	preferredName := ""
+	if cluster.ObjectMeta.Annotations != nil {
+		preferredName = cluster.ObjectMeta.Annotations[bootstrapKubeConfigActiveAnnotation]
+	}
+
+	manager := newBootstrapKubeConfigManager(candidates)
+	active, err := manager.selectActive(preferredName)
+	if err != nil {
+		return nil, err
+	}
+
+	if preferredName != active.Name() && pv.clusterV1alpha1 != nil {
+		ncluster := cluster.DeepCopy()
+		if ncluster.ObjectMeta.Annotations == nil {
+			ncluster.ObjectMeta.Annotations = make(map[string]string)
+		}
+		ncluster.ObjectMeta.Annotations[bootstrapKubeConfigActiveAnnotation] = active.Name()
+		if _, err := pv.clusterV1alpha1.Clusters(cluster.Namespace).Update(ncluster); err != nil {
+			klog.Infof("Could not cache the active kubeconfig candidate on cluster object: %s", err)
+		}
+	}
+
+	return active, nil
+}
@@ -0,0 +1,92 @@
+package govmomi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBootstrapKubeConfigManagerSelectActivePrefersHealthyCandidate(t *testing.T) {
+	candidates := []*BootstrapKubeConfig{
+		NewBootstrapKubeConfig("kubeconfig.0", "stale"),
+		NewBootstrapKubeConfig("kubeconfig.1", "healthy"),
+	}
+	manager := newBootstrapKubeConfigManager(candidates)
+	manager.probe = func(candidate *BootstrapKubeConfig, _ time.Duration) bool {
+		return candidate.Data() == "healthy"
+	}
+
+	active, err := manager.selectActive("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if active.Name() != "kubeconfig.1" {
+		t.Fatalf("expected kubeconfig.1 to be selected, got %s", active.Name())
+	}
+	if candidates[0].Status() != BootstrapKubeConfigValid {
+		t.Fatalf("expected candidate 0 to still be Valid after a single failed probe, got %s", candidates[0].Status())
+	}
+}
+
+func TestBootstrapKubeConfigManagerSelectActivePrefersPreferredName(t *testing.T) {
+	candidates := []*BootstrapKubeConfig{
+		NewBootstrapKubeConfig("kubeconfig.0", "a"),
+		NewBootstrapKubeConfig("kubeconfig.1", "b"),
+	}
+	manager := newBootstrapKubeConfigManager(candidates)
+	probed := []string{}
+	manager.probe = func(candidate *BootstrapKubeConfig, _ time.Duration) bool {
+		probed = append(probed, candidate.Name())
+		return true
+	}
+
+	active, err := manager.selectActive("kubeconfig.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if active.Name() != "kubeconfig.1" {
+		t.Fatalf("expected kubeconfig.1 to be selected, got %s", active.Name())
+	}
+	if probed[0] != "kubeconfig.1" {
+		t.Fatalf("expected the preferred candidate to be probed first, probed order was %v", probed)
+	}
+}
+
+func TestBootstrapKubeConfigManagerDemotesAfterConsecutiveFailures(t *testing.T) {
+	candidate := NewBootstrapKubeConfig("kubeconfig.0", "flaky")
+	manager := newBootstrapKubeConfigManager([]*BootstrapKubeConfig{candidate})
+	manager.probe = func(*BootstrapKubeConfig, time.Duration) bool {
+		return false
+	}
+
+	for i := 0; i < bootstrapKubeConfigMaxConsecutiveFailures; i++ {
+		if _, err := manager.selectActive(""); err != nil {
+			t.Fatalf("unexpected error on attempt %d: %s", i, err)
+		}
+	}
+
+	if candidate.Status() != BootstrapKubeConfigInvalid {
+		t.Fatalf("expected candidate to be demoted to Invalid after %d consecutive failures, got %s", bootstrapKubeConfigMaxConsecutiveFailures, candidate.Status())
+	}
+
+	if _, err := manager.selectActive(""); err == nil {
+		t.Fatalf("expected an error once the only candidate is Invalid")
+	}
+}
+
+func TestBootstrapKubeConfigManagerFallsBackWhenAllProbesFailButNotYetDemoted(t *testing.T) {
+	candidates := []*BootstrapKubeConfig{
+		NewBootstrapKubeConfig("kubeconfig.0", "a"),
+	}
+	manager := newBootstrapKubeConfigManager(candidates)
+	manager.probe = func(*BootstrapKubeConfig, time.Duration) bool {
+		return false
+	}
+
+	active, err := manager.selectActive("")
+	if err != nil {
+		t.Fatalf("expected a transient probe failure to fall back rather than error, got: %s", err)
+	}
+	if active.Name() != "kubeconfig.0" {
+		t.Fatalf("expected fallback to the only candidate, got %s", active.Name())
+	}
+}
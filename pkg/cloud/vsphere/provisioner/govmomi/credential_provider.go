@@ -0,0 +1,173 @@
+package govmomi
+
+import (
+	"fmt"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// credentialProviderUnavailableReason is the distinct ClusterError reason
+// HandleClusterError is invoked with when every configured CredentialProvider
+// fails to produce vSphere credentials.
+var credentialProviderUnavailableReason = common.ClusterStatusError("CredentialProviderUnavailable")
+
+// CredentialProviderUnavailableReason is exported for callers that need to
+// compare against the reason HandleClusterError was invoked with.
+var CredentialProviderUnavailableReason = &credentialProviderUnavailableReason
+
+const (
+	// CredentialProviderKindSecret is the in-cluster Secret reader, CAPV's
+	// original credential source.
+	CredentialProviderKindSecret = "Secret"
+	// CredentialProviderKindVault reads credentials out of a HashiCorp Vault
+	// KV v2 mount, authenticating with a token or AppRole.
+	CredentialProviderKindVault = "Vault"
+	// CredentialProviderKindEnvFile reads credentials from a mounted file,
+	// reloading it on change.
+	CredentialProviderKindEnvFile = "EnvFile"
+)
+
+// CredentialProvider resolves the vSphere username/password to use for
+// cluster. Implementations are composed into a chainCredentialProvider so
+// the backend selected by CredentialProviderRef (e.g. Vault or a mounted
+// file) fails over to the legacy in-cluster Secret.
+type CredentialProvider interface {
+	GetVsphereCredentials(cluster *clusterv1.Cluster) (username, password string, err error)
+}
+
+// credentialProviderCache holds the CredentialProvider chain already built
+// for a given Provisioner+Cluster, keyed by credentialProviderCacheKey.
+// Reconstructing the chain on every GetVsphereCredentials call would reset
+// the Vault provider's in-memory TTL cache on every call and leak an
+// fsnotify watcher goroutine per call for the EnvFile provider, so the chain
+// is built once and reused for the lifetime of the process.
+var (
+	credentialProviderCacheMu sync.Mutex
+	credentialProviderCache   = make(map[string]CredentialProvider)
+)
+
+func credentialProviderCacheKey(pv *Provisioner, cluster *clusterv1.Cluster) string {
+	return fmt.Sprintf("%p/%s/%s", pv, cluster.Namespace, cluster.Name)
+}
+
+// credentialProviderChain returns the CredentialProvider chain for cluster,
+// building it from vsphereConfig.CredentialProviderRef the first time it is
+// requested and reusing it on every subsequent call.
+func (pv *Provisioner) credentialProviderChain(cluster *clusterv1.Cluster) (CredentialProvider, error) {
+	key := credentialProviderCacheKey(pv, cluster)
+
+	credentialProviderCacheMu.Lock()
+	cached, ok := credentialProviderCache[key]
+	credentialProviderCacheMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	chain, err := pv.buildCredentialProviderChain(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	credentialProviderCacheMu.Lock()
+	credentialProviderCache[key] = chain
+	credentialProviderCacheMu.Unlock()
+	return chain, nil
+}
+
+// buildCredentialProviderChain builds the CredentialProvider for cluster out
+// of vsphereConfig.CredentialProviderRef. An unset ref preserves CAPV's
+// original behavior: read vsphereConfig.VsphereCredentialSecret if set,
+// otherwise use the inline VsphereUser/VspherePassword fields.
+func (pv *Provisioner) buildCredentialProviderChain(cluster *clusterv1.Cluster) (CredentialProvider, error) {
+	vsphereConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := vsphereConfig.CredentialProviderRef
+	if ref == nil {
+		return &secretCredentialProvider{pv: pv}, nil
+	}
+
+	var providers []CredentialProvider
+	switch ref.Kind {
+	case CredentialProviderKindVault:
+		providers = append(providers, newVaultCredentialProvider(ref.Vault))
+	case CredentialProviderKindEnvFile:
+		envProvider, err := newEnvFileCredentialProvider(ref.EnvFile.Path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to start env file credential provider: %s", err)
+		}
+		providers = append(providers, envProvider)
+	case CredentialProviderKindSecret, "":
+		providers = append(providers, &secretCredentialProvider{pv: pv})
+	default:
+		return nil, fmt.Errorf("unknown credential provider kind %q", ref.Kind)
+	}
+	// The in-cluster Secret reader is always the last resort, matching CAPV's
+	// original behavior when no other provider has credentials available.
+	if ref.Kind != CredentialProviderKindSecret {
+		providers = append(providers, &secretCredentialProvider{pv: pv})
+	}
+
+	return &chainCredentialProvider{providers: providers}, nil
+}
+
+// secretCredentialProvider is CAPV's original credential source: a Secret
+// named by vsphereConfig.VsphereCredentialSecret, falling back to the inline
+// VsphereUser/VspherePassword fields when no secret is configured.
+type secretCredentialProvider struct {
+	pv *Provisioner
+}
+
+func (s *secretCredentialProvider) GetVsphereCredentials(cluster *clusterv1.Cluster) (string, string, error) {
+	vsphereConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		return "", "", err
+	}
+
+	if vsphereConfig.VsphereCredentialSecret == "" {
+		return vsphereConfig.VsphereUser, vsphereConfig.VspherePassword, nil
+	}
+
+	klog.V(4).Infof("Fetching vsphere credentials from secret %s", vsphereConfig.VsphereCredentialSecret)
+	secret, err := s.pv.k8sClient.Core().Secrets(cluster.Namespace).Get(vsphereConfig.VsphereCredentialSecret, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("Error reading secret %s", vsphereConfig.VsphereCredentialSecret)
+		return "", "", err
+	}
+	username, ok := secret.Data[constants.VsphereUserKey]
+	if !ok {
+		return "", "", fmt.Errorf("Improper secret: Secret %s should have the keys `%s` and `%s` defined in it", vsphereConfig.VsphereCredentialSecret, constants.VsphereUserKey, constants.VspherePasswordKey)
+	}
+	password, ok := secret.Data[constants.VspherePasswordKey]
+	if !ok {
+		return "", "", fmt.Errorf("Improper secret: Secret %s should have the keys `%s` and `%s` defined in it", vsphereConfig.VsphereCredentialSecret, constants.VsphereUserKey, constants.VspherePasswordKey)
+	}
+	return string(username), string(password), nil
+}
+
+// chainCredentialProvider tries each provider in order, returning the first
+// one that succeeds.
+type chainCredentialProvider struct {
+	providers []CredentialProvider
+}
+
+func (c *chainCredentialProvider) GetVsphereCredentials(cluster *clusterv1.Cluster) (string, string, error) {
+	var lastErr error
+	for _, provider := range c.providers {
+		username, password, err := provider.GetVsphereCredentials(cluster)
+		if err == nil {
+			return username, password, nil
+		}
+		klog.Warningf("Credential provider %T failed for cluster %s/%s: %s", provider, cluster.Namespace, cluster.Name, err)
+		lastErr = err
+	}
+	return "", "", fmt.Errorf("all credential providers failed, last error: %s", lastErr)
+}
@@ -0,0 +1,254 @@
+//go:build vault_credentials
+// +build vault_credentials
+
+package govmomi
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/vault/api"
+	"k8s.io/klog"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// This file pulls in the full HashiCorp Vault SDK and fsnotify, neither of
+// which is vendored by default, so it only builds with `-tags
+// vault_credentials`. Without that tag, credential_provider_novault.go
+// supplies stub implementations that report the provider as unavailable.
+
+const (
+	// vaultCredentialTTL bounds how long a Vault-sourced credential is cached
+	// in memory before it is considered stale.
+	vaultCredentialTTL = 10 * time.Minute
+
+	// vaultCredentialRefreshBefore is how far ahead of vaultCredentialTTL
+	// expiring a cached Vault credential is proactively refreshed.
+	vaultCredentialRefreshBefore = 2 * time.Minute
+)
+
+// vaultCachedCredential is a Vault-sourced credential cached in memory until
+// it nears vaultCredentialTTL.
+type vaultCachedCredential struct {
+	username, password string
+	expiresAt          time.Time
+}
+
+// vaultCredentialProvider reads vSphere credentials from a HashiCorp Vault KV
+// v2 mount, caching them in memory and refreshing proactively before they go
+// stale.
+type vaultCredentialProvider struct {
+	config *vsphereutils.VaultCredentialProviderConfig
+
+	mu    sync.Mutex
+	cache map[string]*vaultCachedCredential
+}
+
+func newVaultCredentialProvider(config *vsphereutils.VaultCredentialProviderConfig) CredentialProvider {
+	return &vaultCredentialProvider{
+		config: config,
+		cache:  make(map[string]*vaultCachedCredential),
+	}
+}
+
+func (v *vaultCredentialProvider) GetVsphereCredentials(cluster *clusterv1.Cluster) (string, string, error) {
+	cacheKey := fmt.Sprintf("%s/%s", cluster.Namespace, cluster.Name)
+
+	v.mu.Lock()
+	cached, ok := v.cache[cacheKey]
+	v.mu.Unlock()
+	if ok && time.Until(cached.expiresAt) > vaultCredentialRefreshBefore {
+		return cached.username, cached.password, nil
+	}
+
+	username, password, err := v.readFromVault(cluster)
+	if err != nil {
+		if ok && time.Now().Before(cached.expiresAt) {
+			// Keep serving the stale-but-not-yet-expired credential rather
+			// than failing provisioning outright when Vault is briefly down.
+			klog.Warningf("Vault credential refresh failed for cluster %s/%s, reusing cached credential: %s", cluster.Namespace, cluster.Name, err)
+			return cached.username, cached.password, nil
+		}
+		return "", "", fmt.Errorf("unable to read vsphere credentials from vault: %s", err)
+	}
+
+	v.mu.Lock()
+	v.cache[cacheKey] = &vaultCachedCredential{
+		username:  username,
+		password:  password,
+		expiresAt: time.Now().Add(vaultCredentialTTL),
+	}
+	v.mu.Unlock()
+
+	return username, password, nil
+}
+
+// readFromVault authenticates to Vault with the configured method and reads
+// the KV v2 secret templated per cluster.
+func (v *vaultCredentialProvider) readFromVault(cluster *clusterv1.Cluster) (string, string, error) {
+	client, err := api.NewClient(&api.Config{Address: v.config.Address})
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := v.authenticate(client); err != nil {
+		return "", "", err
+	}
+
+	path := fmt.Sprintf(v.config.Path, cluster.Name)
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return "", "", err
+	}
+	if secret == nil || secret.Data == nil {
+		return "", "", fmt.Errorf("no data found at vault path %s", path)
+	}
+
+	// KV v2 nests the actual secret under a "data" key.
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		data = secret.Data
+	}
+
+	username, _ := data[constants.VsphereUserKey].(string)
+	password, _ := data[constants.VspherePasswordKey].(string)
+	if username == "" || password == "" {
+		return "", "", fmt.Errorf("vault path %s is missing %s or %s", path, constants.VsphereUserKey, constants.VspherePasswordKey)
+	}
+	return username, password, nil
+}
+
+func (v *vaultCredentialProvider) authenticate(client *api.Client) error {
+	switch v.config.AuthMethod {
+	case "AppRole":
+		secret, err := client.Logical().Write("auth/approle/login", map[string]interface{}{
+			"role_id":   v.config.RoleID,
+			"secret_id": v.config.SecretID,
+		})
+		if err != nil {
+			return err
+		}
+		if secret == nil || secret.Auth == nil {
+			return fmt.Errorf("vault approle login returned no auth")
+		}
+		client.SetToken(secret.Auth.ClientToken)
+		return nil
+	default:
+		client.SetToken(v.config.Token)
+		return nil
+	}
+}
+
+// envFileCredentialProvider reads vSphere credentials from a mounted file of
+// VSPHERE_USERNAME/VSPHERE_PASSWORD lines, reloading it whenever fsnotify
+// reports the file changed so a rotated credential takes effect without a
+// restart.
+type envFileCredentialProvider struct {
+	path string
+
+	mu       sync.RWMutex
+	username string
+	password string
+}
+
+func newEnvFileCredentialProvider(path string) (CredentialProvider, error) {
+	p := &envFileCredentialProvider{path: path}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("unable to watch %s for changes: %s", path, err)
+	}
+	if err := watcher.Add(path); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("unable to watch %s for changes: %s", path, err)
+	}
+
+	go p.watch(watcher)
+	return p, nil
+}
+
+func (p *envFileCredentialProvider) watch(watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if err := p.reload(); err != nil {
+				klog.Warningf("Unable to reload credential file %s after change: %s", p.path, err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			klog.Warningf("Error watching credential file %s: %s", p.path, err)
+		}
+	}
+}
+
+func (p *envFileCredentialProvider) reload() error {
+	username, password, err := parseEnvFile(p.path)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.username = username
+	p.password = password
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *envFileCredentialProvider) GetVsphereCredentials(cluster *clusterv1.Cluster) (string, string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.username == "" || p.password == "" {
+		return "", "", fmt.Errorf("credential file %s has no cached credentials", p.path)
+	}
+	return p.username, p.password, nil
+}
+
+// parseEnvFile reads VSPHERE_USERNAME=... and VSPHERE_PASSWORD=... lines out
+// of the file at path.
+func parseEnvFile(path string) (username, password string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "VSPHERE_USERNAME":
+			username = parts[1]
+		case "VSPHERE_PASSWORD":
+			password = parts[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if username == "" || password == "" {
+		return "", "", fmt.Errorf("credential file %s is missing VSPHERE_USERNAME or VSPHERE_PASSWORD", path)
+	}
+	return username, password, nil
+}
@@ -0,0 +1,315 @@
+// Package govmomi: CSR-based node bootstrap.
+//
+// StartNodeCSRApprover requires the workload cluster's
+// certificatesigningrequests and certificatesigningrequests/approval RBAC
+// verbs (get, list, watch, update) on the identity whose kubeconfig
+// GetKubeConfig returns. That identity does not need the built-in
+// system:certificates.k8s.io/kube-apiserver-client-kubelet signer
+// permission granted to kube-controller-manager, because CAPV only approves
+// the CSR here; the workload cluster's own certificate signer issues the
+// certificate once approval is recorded.
+package govmomi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	certificatesv1beta1 "k8s.io/api/certificates/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+const (
+	// csrBootstrapMode is the ProviderSpec BootstrapMode value that selects
+	// per-machine CSR-issued node credentials instead of the cluster-wide
+	// kubeadm bootstrap token.
+	csrBootstrapMode = "CSR"
+
+	// nodeCSRNamePrefix is prepended to every per-machine CSR object name.
+	nodeCSRNamePrefix = "node-csr-"
+
+	// nodeCSRApprovalTimeout bounds how long IssueNodeClientCert waits for the
+	// CSR to be approved and signed before giving up.
+	nodeCSRApprovalTimeout = 5 * time.Minute
+
+	// nodeCSRPollInterval is how often IssueNodeClientCert re-checks the CSR
+	// while waiting for approval.
+	nodeCSRPollInterval = 2 * time.Second
+
+	// nodeClientCertRotateBefore is how far ahead of a kubelet client cert's
+	// recorded expiry RotateNodeClientCertIfNeeded will reissue it.
+	nodeClientCertRotateBefore = 24 * time.Hour
+)
+
+// IssueNodeClientCert generates a private key and CertificateSigningRequest
+// for machine, submits it to cluster's API server, waits for it to be
+// approved and signed, and returns a kubeconfig built from the issued kubelet
+// client certificate. Unlike GetKubeadmToken, this issues one unique identity
+// per Machine instead of sharing a single password-equivalent bootstrap
+// token across the whole cluster.
+func (pv *Provisioner) IssueNodeClientCert(cluster *clusterv1.Cluster, machine *clusterv1.Machine) (string, error) {
+	kubeconfig, err := pv.GetKubeConfig(cluster)
+	if err != nil {
+		return "", err
+	}
+
+	rc, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeconfig))
+	if err != nil {
+		return "", err
+	}
+
+	clusterclient, err := kubernetes.NewForConfig(rest.AddUserAgent(rc, "cluster-api-provider-vsphere"))
+	if err != nil {
+		return "", err
+	}
+
+	commonName := fmt.Sprintf("system:node:%s", machine.Name)
+	keyDER, csrPEM, err := newNodeCSR(commonName)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate CSR for machine %s: %s", machine.Name, err)
+	}
+
+	csr := &certificatesv1beta1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: nodeCSRNamePrefix,
+		},
+		Spec: certificatesv1beta1.CertificateSigningRequestSpec{
+			Request: csrPEM,
+			Usages: []certificatesv1beta1.KeyUsage{
+				certificatesv1beta1.UsageDigitalSignature,
+				certificatesv1beta1.UsageKeyEncipherment,
+				certificatesv1beta1.UsageClientAuth,
+			},
+		},
+	}
+
+	// csr uses GenerateName, so the API server always assigns it a fresh,
+	// never-colliding name: there is no conflict for a retry to resolve here.
+	created, err := clusterclient.CertificatesV1beta1().CertificateSigningRequests().Create(csr)
+	if err != nil {
+		return "", fmt.Errorf("unable to create CSR for machine %s: %s", machine.Name, err)
+	}
+
+	certPEM, err := waitForNodeCertificate(clusterclient, created.Name)
+	if err != nil {
+		return "", fmt.Errorf("machine %s: %s", machine.Name, err)
+	}
+
+	return buildNodeKubeConfig(kubeconfig, commonName, keyDER, certPEM)
+}
+
+// newNodeCSR creates an ECDSA private key and a PEM-encoded
+// CertificateSigningRequest for it with the given common name in the
+// system:nodes organization, as kubelets are required to present.
+func newNodeCSR(commonName string) (keyDER []byte, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err = x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"system:nodes"},
+		},
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	return keyDER, csrPEM, nil
+}
+
+// waitForNodeCertificate polls the named CertificateSigningRequest until the
+// approver goroutine (or an administrator) approves and signs it, or
+// nodeCSRApprovalTimeout elapses.
+func waitForNodeCertificate(clusterclient kubernetes.Interface, name string) ([]byte, error) {
+	var certPEM []byte
+	err := wait.PollImmediate(nodeCSRPollInterval, nodeCSRApprovalTimeout, func() (bool, error) {
+		csr, err := clusterclient.CertificatesV1beta1().CertificateSigningRequests().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if len(csr.Status.Certificate) > 0 {
+			certPEM = csr.Status.Certificate
+			return true, nil
+		}
+		for _, cond := range csr.Status.Conditions {
+			if cond.Type == certificatesv1beta1.CertificateDenied {
+				return false, fmt.Errorf("CSR %s was denied: %s", name, cond.Message)
+			}
+		}
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return nil, fmt.Errorf("timed out waiting for CSR %s to be approved", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for CSR %s to be approved: %s", name, err)
+	}
+	return certPEM, nil
+}
+
+// buildNodeKubeConfig assembles a kubeconfig that authenticates with the
+// issued kubelet client certificate, reusing the cluster connection info from
+// the cluster's kubeconfig returned by GetKubeConfig.
+func buildNodeKubeConfig(sourceKubeConfig, commonName string, keyDER, certPEM []byte) (string, error) {
+	cfg, err := clientcmd.Load([]byte(sourceKubeConfig))
+	if err != nil {
+		return "", fmt.Errorf("unable to parse kubeconfig: %s", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cfg.AuthInfos = map[string]*clientcmdapi.AuthInfo{
+		commonName: {
+			ClientCertificateData: certPEM,
+			ClientKeyData:         keyPEM,
+		},
+	}
+	for _, ctx := range cfg.Contexts {
+		ctx.AuthInfo = commonName
+	}
+
+	out, err := clientcmd.Write(*cfg)
+	if err != nil {
+		return "", fmt.Errorf("unable to serialize node kubeconfig: %s", err)
+	}
+	return string(out), nil
+}
+
+// StartNodeCSRApprover launches a goroutine that watches cluster for
+// CertificateSigningRequests created by IssueNodeClientCert and auto-approves
+// the ones whose requested common name matches the expected
+// "system:node:<name>" pattern for a Machine that actually belongs to
+// cluster, rather than requiring an administrator to approve every join.
+func (pv *Provisioner) StartNodeCSRApprover(cluster *clusterv1.Cluster, stopCh <-chan struct{}) error {
+	kubeconfig, err := pv.GetKubeConfig(cluster)
+	if err != nil {
+		return err
+	}
+
+	rc, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeconfig))
+	if err != nil {
+		return err
+	}
+
+	clusterclient, err := kubernetes.NewForConfig(rest.AddUserAgent(rc, "cluster-api-provider-vsphere"))
+	if err != nil {
+		return err
+	}
+
+	go wait.Until(func() {
+		pv.approvePendingNodeCSRs(cluster, clusterclient)
+	}, nodeCSRPollInterval, stopCh)
+	return nil
+}
+
+// approvePendingNodeCSRs lists outstanding node CSRs and approves the ones
+// this provisioner recognizes as belonging to a control-plane or worker
+// Machine of cluster.
+func (pv *Provisioner) approvePendingNodeCSRs(cluster *clusterv1.Cluster, clusterclient kubernetes.Interface) {
+	csrs, err := clusterclient.CertificatesV1beta1().CertificateSigningRequests().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("Unable to list CertificateSigningRequests for cluster %s/%s: %s", cluster.Namespace, cluster.Name, err)
+		return
+	}
+
+	for i := range csrs.Items {
+		csr := &csrs.Items[i]
+		if isApproved(csr) || len(csr.Status.Certificate) > 0 {
+			continue
+		}
+		if !pv.isExpectedNodeCSR(cluster, csr) {
+			continue
+		}
+
+		csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1beta1.CertificateSigningRequestCondition{
+			Type:    certificatesv1beta1.CertificateApproved,
+			Reason:  "CAPVAutoApprove",
+			Message: "Auto-approved by cluster-api-provider-vsphere node bootstrap",
+		})
+		if _, err := clusterclient.CertificatesV1beta1().CertificateSigningRequests().UpdateApproval(csr); err != nil {
+			klog.Warningf("Unable to approve CSR %s: %s", csr.Name, err)
+		}
+	}
+}
+
+func isApproved(csr *certificatesv1beta1.CertificateSigningRequest) bool {
+	for _, cond := range csr.Status.Conditions {
+		if cond.Type == certificatesv1beta1.CertificateApproved {
+			return true
+		}
+	}
+	return false
+}
+
+// isExpectedNodeCSR reports whether csr's request matches the
+// "system:node:<name>" / "system:nodes" shape generated by newNodeCSR for a
+// Machine that actually belongs to cluster. A CN matching the pattern alone
+// is not enough: without cross-checking cluster's Machines, any requester
+// could name itself "system:node:<anything>" and have it auto-signed.
+func (pv *Provisioner) isExpectedNodeCSR(cluster *clusterv1.Cluster, csr *certificatesv1beta1.CertificateSigningRequest) bool {
+	block, _ := pem.Decode(csr.Spec.Request)
+	if block == nil {
+		return false
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return false
+	}
+
+	hasNodesOrg := false
+	for _, org := range req.Subject.Organization {
+		if org == "system:nodes" {
+			hasNodesOrg = true
+			break
+		}
+	}
+	if !hasNodesOrg {
+		return false
+	}
+
+	machineName := strings.TrimPrefix(req.Subject.CommonName, "system:node:")
+	if machineName == "" || machineName == req.Subject.CommonName {
+		return false
+	}
+
+	machine, err := pv.lister.Machines(cluster.Namespace).Get(machineName)
+	if err != nil {
+		klog.V(4).Infof("CSR %s names machine %s which is not present in cluster %s/%s: %s", csr.Name, machineName, cluster.Namespace, cluster.Name, err)
+		return false
+	}
+	return machine.Labels[clusterv1.MachineClusterLabelName] == cluster.Name
+}
+
+// RotateNodeClientCertIfNeeded reissues machine's node client certificate when
+// the expiry recorded in expiresAt is within nodeClientCertRotateBefore of now,
+// so kubelets never present a certificate after it has expired.
+func (pv *Provisioner) RotateNodeClientCertIfNeeded(cluster *clusterv1.Cluster, machine *clusterv1.Machine, expiresAt time.Time) (string, error) {
+	if time.Until(expiresAt) > nodeClientCertRotateBefore {
+		return "", nil
+	}
+	klog.Infof("Rotating node client certificate for machine %s ahead of expiry at %s", machine.Name, expiresAt)
+	return pv.IssueNodeClientCert(cluster, machine)
+}
@@ -0,0 +1,147 @@
+package govmomi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientauthv1beta1 "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+const (
+	// execCredentialBootstrapMode is the ProviderSpec BootstrapMode value that
+	// selects exec-credential-plugin kubeconfigs instead of the legacy kubeadm
+	// bootstrap token secret.
+	execCredentialBootstrapMode = "ExecCredential"
+
+	// execCredentialAuthInfoName is the AuthInfo entry WriteExecKubeConfig wires
+	// every context to in the kubeconfig it produces.
+	execCredentialAuthInfoName = "capv-exec"
+
+	// execCredentialCommand is the binary the generated kubeconfig's Exec
+	// AuthInfo shells out to in order to mint a fresh credential.
+	execCredentialCommand = "capv-credentials"
+
+	// execCredentialAPIVersion is the client.authentication.k8s.io version the
+	// generated ExecConfig and ExecCredential response both speak.
+	execCredentialAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+	// execCredentialCallerPrefix is the expected form of callerIdentity: the
+	// common name vSphere's guestinfo-derived identity plugin presents,
+	// matching the system:node:<machine> identities IssueNodeClientCert
+	// issues.
+	execCredentialCallerPrefix = "system:node:"
+)
+
+// WriteExecKubeConfig builds a kubeconfig whose AuthInfo shells out to the
+// capv-credentials exec plugin instead of embedding a static credential, so
+// holders of the kubeconfig always authenticate with a freshly minted,
+// short-lived token rather than a long-lived bootstrap secret.
+func (pv *Provisioner) WriteExecKubeConfig(cluster *clusterv1.Cluster) (string, error) {
+	active, err := pv.selectBootstrapKubeConfig(cluster)
+	if err != nil {
+		return "", err
+	}
+	return pv.writeExecKubeConfigFrom(cluster, active.Data())
+}
+
+// writeExecKubeConfigFrom is WriteExecKubeConfig's implementation, taking an
+// already-resolved source kubeconfig so GetKubeConfig can reuse the candidate
+// it already selected instead of probing /readyz a second time.
+func (pv *Provisioner) writeExecKubeConfigFrom(cluster *clusterv1.Cluster, sourceKubeConfig string) (string, error) {
+	cfg, err := clientcmd.Load([]byte(sourceKubeConfig))
+	if err != nil {
+		return "", fmt.Errorf("unable to parse kubeconfig: %s", err)
+	}
+
+	cfg.AuthInfos = map[string]*clientcmdapi.AuthInfo{
+		execCredentialAuthInfoName: {
+			Exec: &clientcmdapi.ExecConfig{
+				APIVersion: execCredentialAPIVersion,
+				Command:    execCredentialCommand,
+				Args:       []string{"get-credential", "--cluster", cluster.Name, "--namespace", cluster.Namespace},
+			},
+		},
+	}
+	for _, ctx := range cfg.Contexts {
+		ctx.AuthInfo = execCredentialAuthInfoName
+	}
+
+	out, err := clientcmd.Write(*cfg)
+	if err != nil {
+		return "", fmt.Errorf("unable to serialize exec-credential kubeconfig: %s", err)
+	}
+	return string(out), nil
+}
+
+// IssueExecCredential is the server-side handler backing the capv-credentials
+// exec plugin: it validates the caller's vSphere-issued identity and returns a
+// JSON ExecCredential carrying a bounded-lifetime bootstrap token.
+func (pv *Provisioner) IssueExecCredential(cluster *clusterv1.Cluster, callerIdentity string) ([]byte, error) {
+	if err := pv.validateExecCredentialCaller(cluster, callerIdentity); err != nil {
+		return nil, err
+	}
+
+	// Use the underlying admin kubeconfig, not GetKubeConfig's exec-wrapped
+	// output, since that has no static credential to authenticate the token
+	// creation call with.
+	active, err := pv.selectBootstrapKubeConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := pv.createKubeadmToken(active.Data())
+	if err != nil {
+		return nil, fmt.Errorf("unable to mint exec credential: %s", err)
+	}
+
+	// The minted value is a real kubeadm bootstrap token whose actual
+	// lifetime is constants.KubeadmTokenTtl; advertise that instead of an
+	// unrelated constant so the plugin doesn't re-mint (and churn bootstrap
+	// token secrets) long before the token it already holds actually expires.
+	expiry := metav1.NewTime(time.Now().Add(constants.KubeadmTokenTtl))
+	cred := &clientauthv1beta1.ExecCredential{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ExecCredential",
+			APIVersion: execCredentialAPIVersion,
+		},
+		Status: &clientauthv1beta1.ExecCredentialStatus{
+			Token:               token,
+			ExpirationTimestamp: &expiry,
+		},
+	}
+
+	out, err := json.Marshal(cred)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode ExecCredential: %s", err)
+	}
+	return out, nil
+}
+
+// validateExecCredentialCaller checks that callerIdentity, the identity
+// vSphere attached to the incoming request, names a Machine that actually
+// belongs to cluster before minting it a credential.
+func (pv *Provisioner) validateExecCredentialCaller(cluster *clusterv1.Cluster, callerIdentity string) error {
+	machineName := strings.TrimPrefix(callerIdentity, execCredentialCallerPrefix)
+	if machineName == "" || machineName == callerIdentity {
+		return fmt.Errorf("exec credential request for cluster %s/%s has malformed caller identity %q", cluster.Namespace, cluster.Name, callerIdentity)
+	}
+
+	machine, err := pv.lister.Machines(cluster.Namespace).Get(machineName)
+	if err != nil {
+		return fmt.Errorf("exec credential request for cluster %s/%s: caller %q does not match a known machine: %s", cluster.Namespace, cluster.Name, callerIdentity, err)
+	}
+	if machine.Labels[clusterv1.MachineClusterLabelName] != cluster.Name {
+		return fmt.Errorf("exec credential request for cluster %s/%s: machine %s does not belong to this cluster", cluster.Namespace, cluster.Name, machineName)
+	}
+
+	klog.V(4).Infof("Issuing exec credential for cluster %s/%s to %s", cluster.Namespace, cluster.Name, callerIdentity)
+	return nil
+}
@@ -0,0 +1,258 @@
+package govmomi
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	machineryerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+const (
+	// remoteSecretLabel marks a Secret produced by GenerateRemoteSecret, or
+	// imported into this management cluster by an operator adopting a
+	// CAPV-provisioned workload cluster from another management cluster.
+	remoteSecretLabel = "vsphere.cluster.k8s.io/remote-secret"
+
+	// remoteSecretKubeConfigKey is the Data key the scoped kubeconfig is
+	// stored under inside a remote secret.
+	remoteSecretKubeConfigKey = "kubeconfig"
+
+	// remoteSecretNameFormat names the remote secret after the cluster it was
+	// generated for.
+	remoteSecretNameFormat = "%s-remote-kubeconfig"
+
+	// remoteSecretTokenWait bounds how long GenerateRemoteSecret waits for the
+	// workload cluster to populate the ServiceAccount token Secret.
+	remoteSecretTokenWait = 30 * time.Second
+
+	// remoteSecretTokenPollInterval is how often GenerateRemoteSecret re-checks
+	// the ServiceAccount token Secret while waiting for it to populate.
+	remoteSecretTokenPollInterval = 2 * time.Second
+)
+
+// GenerateRemoteSecret provisions a ServiceAccount scoped to a minimal
+// ClusterRole in the workload cluster behind cluster, waits for its token to
+// be populated, and returns a Secret wrapping a kubeconfig built from that
+// token. An operator can copy the returned Secret into another management
+// cluster's ImportRemoteSecret lookup to "adopt" the workload cluster without
+// ever handling an admin kubeconfig.
+func (pv *Provisioner) GenerateRemoteSecret(cluster *clusterv1.Cluster, saName, namespace string) (*corev1.Secret, error) {
+	kubeconfig, err := pv.GetKubeConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeconfig))
+	if err != nil {
+		return nil, err
+	}
+
+	clusterclient, err := kubernetes.NewForConfig(rest.AddUserAgent(rc, "cluster-api-provider-vsphere"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensureRemoteServiceAccount(clusterclient, saName, namespace); err != nil {
+		return nil, err
+	}
+
+	tokenSecretName, err := ensureSecretForServiceAccount(clusterclient, saName, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	caData, token, err := waitForServiceAccountToken(clusterclient, tokenSecretName, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	scopedConfig := buildScopedKubeConfig(rc.Host, caData, token)
+	scopedKubeConfig, err := clientcmd.Write(*scopedConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize remote secret kubeconfig: %s", err)
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf(remoteSecretNameFormat, cluster.Name),
+			Namespace: cluster.Namespace,
+			Labels: map[string]string{
+				remoteSecretLabel: "true",
+			},
+		},
+		Data: map[string][]byte{
+			remoteSecretKubeConfigKey: scopedKubeConfig,
+		},
+	}, nil
+}
+
+// ensureRemoteServiceAccount creates saName and a minimal ClusterRole/Binding
+// granting it access to the cluster-api resources an adopting management
+// cluster needs, tolerating objects that already exist from a previous call.
+func ensureRemoteServiceAccount(clusterclient kubernetes.Interface, saName, namespace string) error {
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      saName,
+			Namespace: namespace,
+		},
+	}
+	if _, err := clusterclient.CoreV1().ServiceAccounts(namespace).Create(sa); err != nil && !machineryerrors.IsAlreadyExists(err) {
+		return fmt.Errorf("unable to create service account %s: %s", saName, err)
+	}
+
+	roleName := fmt.Sprintf("capv-remote-%s", saName)
+	role := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: roleName,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{"cluster.k8s.io"},
+				Resources: []string{"clusters", "machines", "machinesets", "machinedeployments"},
+				Verbs:     []string{"get", "list", "watch", "update", "patch"},
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"secrets", "configmaps", "events"},
+				Verbs:     []string{"get", "list", "watch", "create", "update", "patch"},
+			},
+		},
+	}
+	if _, err := clusterclient.RbacV1().ClusterRoles().Create(role); err != nil && !machineryerrors.IsAlreadyExists(err) {
+		return fmt.Errorf("unable to create cluster role %s: %s", roleName, err)
+	}
+
+	binding := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: roleName,
+		},
+		Subjects: []rbacv1.Subject{
+			{Kind: rbacv1.ServiceAccountKind, Name: saName, Namespace: namespace},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     roleName,
+		},
+	}
+	if _, err := clusterclient.RbacV1().ClusterRoleBindings().Create(binding); err != nil && !machineryerrors.IsAlreadyExists(err) {
+		return fmt.Errorf("unable to create cluster role binding %s: %s", roleName, err)
+	}
+
+	return nil
+}
+
+// ensureSecretForServiceAccount creates the ServiceAccount token Secret
+// ourselves and returns its name. Kubernetes versions that no longer
+// auto-provision a token Secret per ServiceAccount require this; creating it
+// unconditionally with the legacy kubernetes.io/service-account.name
+// annotation keeps working on older versions too, since the controller there
+// simply populates the Secret we already created.
+func ensureSecretForServiceAccount(clusterclient kubernetes.Interface, saName, namespace string) (string, error) {
+	secretName := fmt.Sprintf("%s-token", saName)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				corev1.ServiceAccountNameKey: saName,
+			},
+		},
+		Type: corev1.SecretTypeServiceAccountToken,
+	}
+	if _, err := clusterclient.CoreV1().Secrets(namespace).Create(secret); err != nil && !machineryerrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("unable to create token secret for service account %s: %s", saName, err)
+	}
+	return secretName, nil
+}
+
+// waitForServiceAccountToken polls secretName until the control plane
+// populates its ca.crt and token data, which happens asynchronously after the
+// Secret is created.
+func waitForServiceAccountToken(clusterclient kubernetes.Interface, secretName, namespace string) (caData, token []byte, err error) {
+	pollErr := wait.PollImmediate(remoteSecretTokenPollInterval, remoteSecretTokenWait, func() (bool, error) {
+		secret, getErr := clusterclient.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+		if getErr != nil {
+			return false, getErr
+		}
+		if len(secret.Data[corev1.ServiceAccountTokenKey]) == 0 {
+			return false, nil
+		}
+		caData = secret.Data[corev1.ServiceAccountRootCAKey]
+		token = secret.Data[corev1.ServiceAccountTokenKey]
+		return true, nil
+	})
+	if pollErr == wait.ErrWaitTimeout {
+		return nil, nil, fmt.Errorf("timed out waiting for token secret %s to populate", secretName)
+	}
+	if pollErr != nil {
+		return nil, nil, fmt.Errorf("error waiting for token secret %s to populate: %s", secretName, pollErr)
+	}
+	return caData, token, nil
+}
+
+// buildScopedKubeConfig assembles a minimal kubeconfig authenticating with a
+// ServiceAccount's bearer token against host.
+func buildScopedKubeConfig(host string, caData, token []byte) *clientcmdapi.Config {
+	const contextName = "remote-federation"
+	return &clientcmdapi.Config{
+		Clusters: map[string]*clientcmdapi.Cluster{
+			contextName: {
+				Server:                   host,
+				CertificateAuthorityData: caData,
+			},
+		},
+		AuthInfos: map[string]*clientcmdapi.AuthInfo{
+			contextName: {
+				Token: string(token),
+			},
+		},
+		Contexts: map[string]*clientcmdapi.Context{
+			contextName: {
+				Cluster:  contextName,
+				AuthInfo: contextName,
+			},
+		},
+		CurrentContext: contextName,
+	}
+}
+
+// ImportRemoteSecret looks up the Secret named by remoteSecretNameFormat in
+// cluster's namespace and, if it exists and carries remoteSecretLabel,
+// returns the kubeconfig it wraps. This
+// is the inverse of GenerateRemoteSecret: an operator adopts a
+// CAPV-provisioned workload cluster from a different management cluster by
+// copying the generated Secret here, and GetKubeConfig transparently prefers
+// it over the local KubeConfigSecretName secret.
+func (pv *Provisioner) ImportRemoteSecret(cluster *clusterv1.Cluster) (string, bool, error) {
+	name := fmt.Sprintf(remoteSecretNameFormat, cluster.Name)
+	secret, err := pv.k8sClient.Core().Secrets(cluster.Namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if machineryerrors.IsNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	if secret.Labels[remoteSecretLabel] != "true" {
+		return "", false, nil
+	}
+
+	data, ok := secret.Data[remoteSecretKubeConfigKey]
+	if !ok {
+		return "", false, fmt.Errorf("remote secret %s is missing key %s", name, remoteSecretKubeConfigKey)
+	}
+
+	klog.V(4).Infof("Using imported remote secret %s for cluster %s/%s", name, cluster.Namespace, cluster.Name)
+	return string(data), true, nil
+}
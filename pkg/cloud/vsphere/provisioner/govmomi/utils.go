@@ -45,16 +45,28 @@ func (pv *Provisioner) GetKubeadmToken(cluster *clusterv1.Cluster) (string, erro
 		return "", errors.New("No control plane nodes available")
 	}
 
-	kubeconfig, err := pv.GetKubeConfig(cluster)
+	// Use the underlying admin kubeconfig, not GetKubeConfig's exec-wrapped
+	// output, since that has no static credential to authenticate the token
+	// creation call with (see IssueExecCredential, which has the same need).
+	active, err := pv.selectBootstrapKubeConfig(cluster)
 	if err != nil {
 		return "", err
 	}
 
-	token, err = pv.createKubeadmToken(kubeconfig)
+	token, err = pv.createKubeadmToken(active.Data())
 	if err != nil {
 		return "", err
 	}
 
+	// In exec-credential and per-machine CSR modes, there is no cluster-wide
+	// token worth caching: exec-credential tokens are minted fresh per
+	// invocation, and CSR mode replaces the shared token with one identity per
+	// Machine via IssueNodeClientCert.
+	vsphereConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err == nil && (vsphereConfig.BootstrapMode == execCredentialBootstrapMode || vsphereConfig.BootstrapMode == csrBootstrapMode) {
+		return token, nil
+	}
+
 	ncluster := cluster.DeepCopy()
 	if ncluster.ObjectMeta.Annotations == nil {
 		ncluster.ObjectMeta.Annotations = make(map[string]string)
@@ -185,34 +197,44 @@ func (pv *Provisioner) GetSSHPublicKey(cluster *clusterv1.Cluster) (string, erro
 	return string(secret.Data["vsphere_tmp.pub"]), nil
 }
 
+// GetKubeConfig returns the kubeconfig for cluster. When the secret named by
+// constants.KubeConfigSecretName holds more than one candidate kubeconfig, the
+// first one that answers a /readyz health probe is returned, so provisioning
+// keeps working against a still-reachable API server rather than hard-failing
+// on a stale endpoint. In exec-credential mode, the returned kubeconfig shells
+// out to the capv-credentials exec plugin instead of embedding a static
+// credential; see WriteExecKubeConfig.
 func (pv *Provisioner) GetKubeConfig(cluster *clusterv1.Cluster) (string, error) {
-	secret, err := pv.k8sClient.Core().Secrets(cluster.Namespace).Get(fmt.Sprintf(constants.KubeConfigSecretName, cluster.UID), metav1.GetOptions{})
+	active, err := pv.selectBootstrapKubeConfig(cluster)
 	if err != nil {
 		return "", err
 	}
-	return string(secret.Data[constants.KubeConfigSecretData]), nil
+
+	vsphereConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err == nil && vsphereConfig.BootstrapMode == execCredentialBootstrapMode {
+		return pv.writeExecKubeConfigFrom(cluster, active.Data())
+	}
+	return active.Data(), nil
 }
 
+// GetVsphereCredentials resolves the vSphere username/password for cluster.
+// It delegates to the CredentialProvider chain built from
+// vsphereConfig.CredentialProviderRef (using secretCredentialProvider's
+// in-cluster Secret and inline-credential behavior when no ref is set), so existing
+// callers keep working unchanged regardless of which backend is configured.
 func (pv *Provisioner) GetVsphereCredentials(cluster *clusterv1.Cluster) (string, string, error) {
-	vsphereConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	chain, err := pv.credentialProviderChain(cluster)
 	if err != nil {
 		return "", "", err
 	}
-	// If the vsphereCredentialSecret is specified then read that secret to get the credentials
-	if vsphereConfig.VsphereCredentialSecret != "" {
-		klog.V(4).Infof("Fetching vsphere credentials from secret %s", vsphereConfig.VsphereCredentialSecret)
-		secret, err := pv.k8sClient.Core().Secrets(cluster.Namespace).Get(vsphereConfig.VsphereCredentialSecret, metav1.GetOptions{})
-		if err != nil {
-			klog.Warningf("Error reading secret %s", vsphereConfig.VsphereCredentialSecret)
-			return "", "", err
-		}
-		if username, ok := secret.Data[constants.VsphereUserKey]; ok {
-			if password, ok := secret.Data[constants.VspherePasswordKey]; ok {
-				return string(username), string(password), nil
-			}
-		}
-		return "", "", fmt.Errorf("Improper secret: Secret %s should have the keys `%s` and `%s` defined in it", vsphereConfig.VsphereCredentialSecret, constants.VsphereUserKey, constants.VspherePasswordKey)
-	}
-	return vsphereConfig.VsphereUser, vsphereConfig.VspherePassword, nil
 
+	username, password, err := chain.GetVsphereCredentials(cluster)
+	if err != nil {
+		pv.HandleClusterError(cluster, &apierrors.ClusterError{
+			Reason:  credentialProviderUnavailableReason,
+			Message: err.Error(),
+		}, "")
+		return "", "", err
+	}
+	return username, password, nil
 }
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// ClusterProviderSpec is the vSphere-specific configuration embedded in a
+// Cluster's ProviderSpec.
+type ClusterProviderSpec struct {
+	VsphereUser             string `json:"vsphereUser,omitempty"`
+	VspherePassword         string `json:"vspherePassword,omitempty"`
+	VsphereCredentialSecret string `json:"vsphereCredentialSecret,omitempty"`
+
+	// BootstrapMode selects how GetKubeadmToken and GetKubeConfig issue
+	// bootstrap credentials for machines joining this cluster. An empty value
+	// keeps the legacy cluster-wide kubeadm token behavior.
+	BootstrapMode string `json:"bootstrapMode,omitempty"`
+
+	// CredentialProviderRef selects the backend GetVsphereCredentials resolves
+	// vSphere credentials from. A nil ref keeps the legacy behavior of reading
+	// VsphereCredentialSecret (or VsphereUser/VspherePassword) directly.
+	CredentialProviderRef *CredentialProviderRef `json:"credentialProviderRef,omitempty"`
+}
+
+// CredentialProviderRef selects and configures one CredentialProvider
+// backend. It is a discriminated union on Kind: exactly the field matching
+// Kind is read.
+type CredentialProviderRef struct {
+	// Kind is one of "Secret", "Vault", or "EnvFile".
+	Kind string `json:"kind"`
+
+	// Vault configures the Vault-backed provider. Only read when Kind is "Vault".
+	Vault *VaultCredentialProviderConfig `json:"vault,omitempty"`
+
+	// EnvFile configures the mounted-file-backed provider. Only read when Kind
+	// is "EnvFile".
+	EnvFile *EnvFileCredentialProviderConfig `json:"envFile,omitempty"`
+}
+
+// VaultCredentialProviderConfig configures a HashiCorp Vault KV v2 credential
+// source.
+type VaultCredentialProviderConfig struct {
+	// Address is the Vault server address, e.g. "https://vault.example.com:8200".
+	Address string `json:"address"`
+
+	// Path is the KV v2 secret path to read, formatted with the cluster name,
+	// e.g. "secret/data/vsphere/%s".
+	Path string `json:"path"`
+
+	// AuthMethod selects how to authenticate to Vault: "AppRole" uses RoleID
+	// and SecretID; any other value (including empty) authenticates with the
+	// static Token below.
+	AuthMethod string `json:"authMethod,omitempty"`
+
+	// Token is the Vault token used when AuthMethod is not "AppRole".
+	Token string `json:"token,omitempty"`
+
+	// RoleID is the AppRole role_id, used when AuthMethod is "AppRole".
+	RoleID string `json:"roleId,omitempty"`
+
+	// SecretID is the AppRole secret_id, used when AuthMethod is "AppRole".
+	SecretID string `json:"secretId,omitempty"`
+}
+
+// EnvFileCredentialProviderConfig configures a mounted-file credential
+// source.
+type EnvFileCredentialProviderConfig struct {
+	// Path is the file containing VSPHERE_USERNAME=... and
+	// VSPHERE_PASSWORD=... lines.
+	Path string `json:"path"`
+}
+
+// GetClusterProviderSpec decodes the vSphere ClusterProviderSpec embedded in
+// providerSpec.
+func GetClusterProviderSpec(providerSpec clusterv1.ProviderSpec) (*ClusterProviderSpec, error) {
+	if providerSpec.Value == nil {
+		return nil, fmt.Errorf("no Value in ProviderSpec")
+	}
+	spec := &ClusterProviderSpec{}
+	if err := json.Unmarshal(providerSpec.Value.Raw, spec); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal cluster provider spec: %s", err)
+	}
+	return spec, nil
+}